@@ -4,7 +4,9 @@
 package limit
 
 import (
+	"context"
 	"errors"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
@@ -23,12 +25,89 @@ var (
 // Bucket interface implements the leaky-bucket algorithm and is used by
 // the Transport to rate limit out going requests.
 type Bucket interface {
-	// Consume consumes from the bucket and returns the bucket
-	// state. In the case the rate limit is exceeded Consume
+	// Consume consumes from the bucket identified by key and returns
+	// the bucket state. In the case the rate limit is exceeded Consume
 	// must return ErrTooManyRequests.
 	//
+	// key lets a single Bucket track independent budgets, e.g. per
+	// upstream host or per tenant; implementations that don't need
+	// that may ignore it.
+	//
+	// Consume must honor ctx cancellation/deadlines, returning
+	// ctx.Err() if ctx is done before the bucket can be consulted.
+	//
 	// Implementations of Consume are required to be thread safe.
-	Consume(int) (State, error)
+	Consume(ctx context.Context, key string, amt int) (State, error)
+}
+
+// LegacyBucket is the pre-context, pre-keying Bucket interface.
+// WrapLegacy adapts implementations of it to satisfy Bucket.
+type LegacyBucket interface {
+	Consume(amt int) (State, error)
+}
+
+// WrapLegacy adapts a LegacyBucket, whose Consume has neither a ctx nor
+// a key parameter, to the Bucket interface. The returned Bucket cannot
+// be cancelled and ignores key, consuming from a single shared budget.
+func WrapLegacy(b LegacyBucket) Bucket {
+	return legacyBucket{b}
+}
+
+type legacyBucket struct {
+	LegacyBucket
+}
+
+func (b legacyBucket) Consume(ctx context.Context, key string, amt int) (State, error) {
+	return b.LegacyBucket.Consume(amt)
+}
+
+// Reserver is an optional extension of Bucket, implemented by buckets
+// that can wait out a rate limit instead of rejecting outright.
+type Reserver interface {
+	// Reserve behaves like Consume, except that if amt isn't
+	// immediately available it blocks until it is, up to maxWait, and
+	// only returns ErrToManyRequests if the bucket won't free up
+	// enough capacity within maxWait.
+	Reserve(ctx context.Context, key string, amt int, maxWait time.Duration) (State, error)
+}
+
+// Reserve implements the wait-then-retry semantics described by
+// Reserver.Reserve: it calls bucket.Consume once, and if that's
+// rejected, sleeps until bucket reports capacity will free up before
+// retrying once. If that wait is longer than maxWait it returns
+// ErrToManyRequests straight away, without sleeping. Bucket implementations backing a
+// Reserver can delegate to this instead of duplicating the wait/retry
+// loop.
+func Reserve(ctx context.Context, bucket Bucket, key string, amt int, maxWait time.Duration) (State, error) {
+	state, err := bucket.Consume(ctx, key, amt)
+	if err == nil || !errors.Is(err, ErrToManyRequests) {
+		return state, err
+	}
+
+	wait := time.Until(state.Reset)
+	if wait > maxWait {
+		return state, ErrToManyRequests
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return State{}, ctx.Err()
+	case <-timer.C:
+		return bucket.Consume(ctx, key, amt)
+	}
+}
+
+// Penalizer is an optional extension of Bucket, implemented by buckets
+// that can record an externally imposed back-off, e.g. an upstream's
+// Retry-After.
+type Penalizer interface {
+	// Penalize marks key as exhausted until the given time. Buckets
+	// shared across replicas must make the penalty visible to all of
+	// them, not just the caller.
+	Penalize(ctx context.Context, key string, until time.Time) error
 }
 
 // State represents a bucket's state.
@@ -45,12 +124,43 @@ func (s State) setXRateHeaders(r *http.Response) {
 	r.Header.Set(xRateLimitRest, strconv.Itoa(remaining))
 }
 
+// Keyer derives the Bucket key to consume from for an outgoing request.
+type Keyer func(*http.Request) string
+
+// KeyByHost is a Keyer that rate limits independently per request host,
+// useful when a single Transport serves several upstream APIs.
+func KeyByHost(req *http.Request) string {
+	return req.URL.Host
+}
+
+// KeyByHeader returns a Keyer that rate limits independently per value
+// of the named request header, e.g. an API token or tenant ID.
+func KeyByHeader(name string) Keyer {
+	return func(req *http.Request) string {
+		return req.Header.Get(name)
+	}
+}
+
 // Transport is an implementation of http.RoundTripper that will rate limit
 // outgoing requests using the leaky-bucket algorithm, avoiding over-limit
 // network requests, instead transprently returning a 429 / Too Many Requests.
 type Transport struct {
 	Transport http.RoundTripper
 	Bucket    Bucket
+
+	// Keyer derives the Bucket key for each outgoing request. If nil,
+	// every request consumes from the same key.
+	Keyer Keyer
+
+	// MaxWait, if non-zero and Bucket implements Reserver, makes
+	// RoundTrip block for up to MaxWait for capacity to free up
+	// instead of immediately synthesizing a 429.
+	MaxWait time.Duration
+
+	// ErrorLog, if non-nil, receives errors RoundTrip can't otherwise
+	// report through its return value, such as a failed Penalize call.
+	// Defaults to the standard logger.
+	ErrorLog *log.Logger
 }
 
 // NewTransport returns a new Transport with the provided
@@ -74,7 +184,12 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		transport = http.DefaultTransport
 	}
 
-	state, err := t.Bucket.Consume(1)
+	var key string
+	if t.Keyer != nil {
+		key = t.Keyer(req)
+	}
+
+	state, err := t.consume(req, key)
 	if err != nil {
 		if errors.Is(err, ErrToManyRequests) {
 			resp := http.Response{
@@ -98,5 +213,68 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	// Assume our bucket is more accurate than third party.
 	state.setXRateHeaders(resp)
 
+	if resp.StatusCode == http.StatusTooManyRequests {
+		t.penalize(req, key, resp)
+	}
+
 	return resp, nil
 }
+
+// consume consumes amount 1 from key, preferring Reserve (waiting up
+// to MaxWait for capacity) over Consume when both MaxWait is set and
+// the Bucket supports it.
+func (t *Transport) consume(req *http.Request, key string) (State, error) {
+	if t.MaxWait > 0 {
+		if reserver, ok := t.Bucket.(Reserver); ok {
+			return reserver.Reserve(req.Context(), key, 1, t.MaxWait)
+		}
+	}
+
+	return t.Bucket.Consume(req.Context(), key, 1)
+}
+
+// penalize pushes resp's Retry-After, if present, into the Bucket so
+// that every replica sharing key immediately starts backing off.
+func (t *Transport) penalize(req *http.Request, key string, resp *http.Response) {
+	penalizer, ok := t.Bucket.(Penalizer)
+	if !ok {
+		return
+	}
+
+	until, ok := retryAfter(resp)
+	if !ok {
+		return
+	}
+
+	if err := penalizer.Penalize(req.Context(), key, until); err != nil {
+		t.logf("limit: Penalize(%q) failed: %v", key, err)
+	}
+}
+
+// logf writes to t.ErrorLog, falling back to the standard logger.
+func (t *Transport) logf(format string, args ...interface{}) {
+	if t.ErrorLog != nil {
+		t.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// retryAfter parses resp's Retry-After header, which may be either a
+// number of seconds or an HTTP date, per RFC 7231 §7.1.3.
+func retryAfter(resp *http.Response) (time.Time, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return time.Time{}, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Now().Add(time.Duration(secs) * time.Second), true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return t, true
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,222 @@
+package limit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// keyedBucket is a test-only Bucket that tracks which keys it was
+// consumed with, to assert Transport resolves the right one.
+type keyedBucket struct {
+	keys []string
+}
+
+func (b *keyedBucket) Consume(ctx context.Context, key string, amt int) (State, error) {
+	b.keys = append(b.keys, key)
+	return State{Capacity: 1, Space: 1, Reset: time.Now()}, nil
+}
+
+func Test_Transport_Keyer(t *testing.T) {
+	bucket := &keyedBucket{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	transport := NewTransport(bucket)
+	transport.Keyer = KeyByHeader("X-Tenant")
+	client := transport.Client()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("X-Tenant", "acme")
+
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bucket.keys) != 1 || bucket.keys[0] != "acme" {
+		t.Errorf("expected Consume to be called with key %q, got %v", "acme", bucket.keys)
+	}
+}
+
+func Test_Transport_NoKeyer(t *testing.T) {
+	bucket := &keyedBucket{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	client := NewTransport(bucket).Client()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bucket.keys) != 1 || bucket.keys[0] != "" {
+		t.Errorf("expected Consume to be called with empty key, got %v", bucket.keys)
+	}
+}
+
+// reserverBucket is a test-only Bucket that also implements Reserver,
+// recording whether Reserve was dispatched to and with what maxWait.
+type reserverBucket struct {
+	keyedBucket
+	reserved    bool
+	reserveWait time.Duration
+}
+
+func (b *reserverBucket) Reserve(ctx context.Context, key string, amt int, maxWait time.Duration) (State, error) {
+	b.reserved = true
+	b.reserveWait = maxWait
+	return b.Consume(ctx, key, amt)
+}
+
+func Test_Transport_MaxWait_PrefersReserve(t *testing.T) {
+	bucket := &reserverBucket{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	transport := NewTransport(bucket)
+	transport.MaxWait = 250 * time.Millisecond
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := transport.Client().Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bucket.reserved {
+		t.Error("expected RoundTrip to call Reserve when MaxWait is set and Bucket implements Reserver")
+	}
+	if bucket.reserveWait != transport.MaxWait {
+		t.Errorf("expected Reserve to be called with maxWait %s, got %s", transport.MaxWait, bucket.reserveWait)
+	}
+}
+
+func Test_Transport_NoMaxWait_UsesConsume(t *testing.T) {
+	bucket := &reserverBucket{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := NewTransport(bucket).Client().Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if bucket.reserved {
+		t.Error("expected RoundTrip not to call Reserve when MaxWait is zero")
+	}
+	if len(bucket.keys) != 1 {
+		t.Errorf("expected Consume to be called once, got %d", len(bucket.keys))
+	}
+}
+
+// penalizerBucket is a test-only Bucket that also implements
+// Penalizer, recording the key/until it was called with.
+type penalizerBucket struct {
+	keyedBucket
+	penalizeKey   string
+	penalizeUntil time.Time
+	penalizeErr   error
+}
+
+func (b *penalizerBucket) Penalize(ctx context.Context, key string, until time.Time) error {
+	b.penalizeKey = key
+	b.penalizeUntil = until
+	return b.penalizeErr
+}
+
+func Test_Transport_Penalize_OnRetryAfter(t *testing.T) {
+	bucket := &penalizerBucket{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	transport := NewTransport(bucket)
+	transport.Keyer = KeyByHeader("X-Tenant")
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("X-Tenant", "acme")
+
+	start := time.Now()
+	if _, err := transport.Client().Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if bucket.penalizeKey != "acme" {
+		t.Errorf("expected Penalize to be called with key %q, got %q", "acme", bucket.penalizeKey)
+	}
+	if bucket.penalizeUntil.Before(start) || bucket.penalizeUntil.After(start.Add(2*time.Second)) {
+		t.Errorf("expected Penalize's until to be ~1s out, got %s", bucket.penalizeUntil.Sub(start))
+	}
+}
+
+func Test_Transport_Penalize_LogsError(t *testing.T) {
+	bucket := &penalizerBucket{penalizeErr: errors.New("boom")}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	var logged bytes.Buffer
+
+	transport := NewTransport(bucket)
+	transport.ErrorLog = log.New(&logged, "", 0)
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := transport.Client().Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if logged.Len() == 0 {
+		t.Error("expected a failed Penalize to be logged to Transport.ErrorLog")
+	}
+}
+
+func Test_RetryAfter(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name   string
+		header string
+		wantOK bool
+	}{
+		{"absent", "", false},
+		{"seconds", "120", true},
+		{"httpDate", now.Add(time.Hour).UTC().Format(http.TimeFormat), true},
+		{"garbage", "not-a-time", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp := &http.Response{Header: make(http.Header)}
+			if c.header != "" {
+				resp.Header.Set("Retry-After", c.header)
+			}
+
+			_, ok := retryAfter(resp)
+			if ok != c.wantOK {
+				t.Errorf("retryAfter(%q): got ok=%v, want %v", c.header, ok, c.wantOK)
+			}
+		})
+	}
+}
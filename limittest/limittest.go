@@ -0,0 +1,156 @@
+// Package limittest provides a conformance test suite that any
+// limit.Bucket implementation should satisfy. It's used by both the
+// redis and memory packages so the two implementations are held to
+// the same behavioral contract.
+package limittest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tjcain/limit"
+)
+
+// Capacity and Rate are the bucket configuration every implementation
+// under test must be constructed with.
+const (
+	Capacity = 2
+	Rate     = time.Second
+)
+
+// Sync drives bucket through a Transport and asserts that the first
+// Capacity requests succeed and the rest are rejected with 429.
+func Sync(t *testing.T, bucket limit.Bucket) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	client := limit.NewTransport(bucket).Client()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+
+	for i := 0; i < Capacity*2; i++ {
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i >= Capacity {
+			if resp.StatusCode != 429 {
+				t.Errorf("request %d: expected status 429, got %d", i, resp.StatusCode)
+			}
+		} else {
+			if resp.StatusCode != 200 {
+				t.Errorf("request %d: expected status 200, got %d", i, resp.StatusCode)
+			}
+		}
+	}
+}
+
+// Reserve drains bucket (configured with Capacity requests per Rate)
+// and then exercises Reserve, asserting it succeeds after waiting no
+// longer than Rate, and that it fails outright once the wait would
+// exceed maxWait. bucket must implement limit.Reserver.
+func Reserve(t *testing.T, bucket limit.Bucket) {
+	reserver, ok := bucket.(limit.Reserver)
+	if !ok {
+		t.Fatalf("%T does not implement limit.Reserver", bucket)
+	}
+
+	ctx := context.Background()
+
+	for i := 0; i < Capacity; i++ {
+		if _, err := bucket.Consume(ctx, "", 1); err != nil {
+			t.Fatalf("Consume %d: %v", i, err)
+		}
+	}
+
+	start := time.Now()
+	if _, err := reserver.Reserve(ctx, "", 1, Rate); err != nil {
+		t.Fatalf("expected Reserve to succeed within Rate, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > Rate {
+		t.Errorf("expected Reserve to wait no longer than Rate (%s), waited %s", Rate, elapsed)
+	}
+
+	if _, err := reserver.Reserve(ctx, "", Capacity, time.Millisecond); err != limit.ErrToManyRequests {
+		t.Errorf("expected ErrToManyRequests when the wait would exceed maxWait, got %v", err)
+	}
+}
+
+// Penalize drives bucket through Penalize, asserting that Consume is
+// rejected both immediately afterward and on a later call, and that
+// the rejection's State.Reset reflects the penalty's deadline rather
+// than the bucket's ordinary refill rate. bucket must implement
+// limit.Penalizer.
+func Penalize(t *testing.T, bucket limit.Bucket) {
+	penalizer, ok := bucket.(limit.Penalizer)
+	if !ok {
+		t.Fatalf("%T does not implement limit.Penalizer", bucket)
+	}
+
+	ctx := context.Background()
+	until := time.Now().Add(10 * Rate)
+
+	if err := penalizer.Penalize(ctx, "", until); err != nil {
+		t.Fatalf("Penalize: %v", err)
+	}
+
+	state, err := bucket.Consume(ctx, "", 1)
+	if err != limit.ErrToManyRequests {
+		t.Fatalf("expected Consume to be rejected after Penalize, got %v", err)
+	}
+	if d := state.Reset.Sub(until); d < -Rate || d > Rate {
+		t.Errorf("expected State.Reset to reflect the Penalize deadline (%s), got %s (off by %s)", until, state.Reset, d)
+	}
+
+	// The penalty must still hold on a later Consume, not just the one
+	// immediately after Penalize.
+	state, err = bucket.Consume(ctx, "", 1)
+	if err != limit.ErrToManyRequests {
+		t.Fatalf("expected Consume to still be rejected shortly after Penalize, got %v", err)
+	}
+	if d := state.Reset.Sub(until); d < -Rate || d > Rate {
+		t.Errorf("expected the second Consume's State.Reset to still reflect the Penalize deadline, got %s (off by %s)", state.Reset, d)
+	}
+}
+
+// Concurrency hits bucket with many concurrent Consume calls and
+// asserts that no more than Capacity of them succeed, i.e. that the
+// implementation correctly serializes its check-and-decrement.
+func Concurrency(t *testing.T, bucket limit.Bucket) {
+	const attempts = Capacity * 5
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := bucket.Consume(context.Background(), "", 1)
+			switch err {
+			case nil:
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			case limit.ErrToManyRequests:
+			default:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if allowed > Capacity {
+		t.Errorf("expected at most %d requests to be allowed, got %d", Capacity, allowed)
+	}
+}
@@ -0,0 +1,123 @@
+// Package memory provides an in-process implementation of the
+// limit.Bucket interface. It requires no external dependencies, making
+// it a convenient stand-in for the redis-backed bucket in unit tests
+// or single-node deployments that don't need a shared rate limit.
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/tjcain/limit"
+)
+
+// window tracks the amount consumed so far in a fixed time window.
+type window struct {
+	start time.Time
+	used  int
+}
+
+// Bucket implements the limit.Bucket interface using a local,
+// in-memory fixed window counter, analogous to the FrontendRateLimiter
+// split used in proxyd.
+type Bucket struct {
+	mu sync.Mutex
+
+	capacity int
+	rate     time.Duration
+
+	// windows holds each key's current window. A stale window (one
+	// whose start has fallen behind the current truncated time) is
+	// replaced the next time its key is consumed.
+	//
+	// TODO: this never evicts keys that stop being used, so a Bucket
+	// fed a high-cardinality or unbounded key (e.g. IP address) will
+	// grow without bound.
+	windows map[string]window
+
+	// penalties holds, per key, a deadline before which Consume must
+	// reject outright. It's tracked separately from windows because a
+	// fixed window can't express "blocked until an arbitrary future
+	// time" - the window's own advance-and-reset logic would discard
+	// an exhausted window the moment the current window changes,
+	// regardless of whether the penalty's deadline had passed.
+	penalties map[string]time.Time
+}
+
+// NewLocalBucket returns a Bucket that allows capacity amount to be
+// consumed per rate duration, tracked independently per key.
+func NewLocalBucket(capacity int, rate time.Duration) *Bucket {
+	return &Bucket{
+		capacity:  capacity,
+		rate:      rate,
+		windows:   make(map[string]window),
+		penalties: make(map[string]time.Time),
+	}
+}
+
+// Consume implements the limit.Bucket interface.
+func (b *Bucket) Consume(ctx context.Context, key string, amt int) (limit.State, error) {
+	if err := ctx.Err(); err != nil {
+		return limit.State{}, err
+	}
+
+	wallNow := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if until, ok := b.penalties[key]; ok {
+		if wallNow.Before(until) {
+			return limit.State{Capacity: b.capacity, Reset: until}, limit.ErrToManyRequests
+		}
+		delete(b.penalties, key)
+	}
+
+	now := wallNow.Truncate(b.rate)
+
+	w := b.windows[key]
+	if w.start != now {
+		w = window{start: now}
+	}
+
+	state := limit.State{
+		Capacity: b.capacity,
+		Reset:    now.Add(b.rate),
+	}
+
+	if w.used+amt > b.capacity {
+		state.Space = b.capacity - w.used
+		b.windows[key] = w
+		return state, limit.ErrToManyRequests
+	}
+
+	w.used += amt
+	b.windows[key] = w
+	state.Space = b.capacity - w.used
+
+	return state, nil
+}
+
+// Reserve implements limit.Reserver by delegating to limit.Reserve,
+// which attempts Consume immediately and, if key is over limit, sleeps
+// until state.Reset before retrying once, or returns
+// limit.ErrToManyRequests without sleeping if that's beyond maxWait.
+func (b *Bucket) Reserve(ctx context.Context, key string, amt int, maxWait time.Duration) (limit.State, error) {
+	return limit.Reserve(ctx, b, key, amt, maxWait)
+}
+
+// Penalize implements limit.Penalizer by rejecting Consume for key
+// until the given time.
+func (b *Bucket) Penalize(ctx context.Context, key string, until time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.penalties[key] = until
+
+	return nil
+}
@@ -0,0 +1,23 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/tjcain/limit/limittest"
+)
+
+func Test_Bucket_Sync(t *testing.T) {
+	limittest.Sync(t, NewLocalBucket(limittest.Capacity, limittest.Rate))
+}
+
+func Test_Bucket_Concurrency(t *testing.T) {
+	limittest.Concurrency(t, NewLocalBucket(limittest.Capacity, limittest.Rate))
+}
+
+func Test_Bucket_Reserve(t *testing.T) {
+	limittest.Reserve(t, NewLocalBucket(limittest.Capacity, limittest.Rate))
+}
+
+func Test_Bucket_Penalize(t *testing.T) {
+	limittest.Penalize(t, NewLocalBucket(limittest.Capacity, limittest.Rate))
+}
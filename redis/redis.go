@@ -1,128 +1,336 @@
 package redis
 
 import (
+	"context"
 	"errors"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v7"
 	"github.com/tjcain/limit"
 )
 
+// tokenBucketScript atomically refills and consumes from a token bucket.
+// The bucket's remaining tokens and the timestamp of the last refill are
+// stored as two string keys (KEYS[1] and KEYS[2], both set to expire after
+// rate_ms of inactivity so abandoned buckets don't linger in redis).
+//
+// KEYS:  {tokens_key, ts_key}
+// ARGV:  {capacity, rate_ms, now_ms, amount}
+// return: {allowed (0/1), remaining tokens, reset_ms}
+//
+// When the call is rejected, reset_ms is the time until amount tokens
+// are available - not until the bucket is merely non-empty, and not
+// until it's back to full. When the call is allowed, reset_ms is the
+// time until the bucket is back to full capacity. It also
+// accounts for ts_key having been pinned into the future by Penalize,
+// in which case no tokens accrue until that time arrives.
+//
+// Running this as a single script makes the check-and-decrement atomic
+// across every replica sharing a key, removing the need for WATCH/MULTI
+// round trips or a local mutex.
+const tokenBucketScript = `
+local tokens_key = KEYS[1]
+local ts_key = KEYS[2]
+
+local capacity = tonumber(ARGV[1])
+local rate_ms = tonumber(ARGV[2])
+local now_ms = tonumber(ARGV[3])
+local amount = tonumber(ARGV[4])
+
+local stored = tonumber(redis.call("GET", tokens_key))
+if stored == nil then
+	stored = capacity
+end
+
+local last = tonumber(redis.call("GET", ts_key))
+if last == nil then
+	last = now_ms
+end
+
+-- last may be pinned ahead of now_ms (Penalize does this so the
+-- bucket doesn't refill until the penalty expires); refill never
+-- starts before last.
+local refill_start = math.max(now_ms, last)
+local elapsed = math.max(0, now_ms - last)
+local tokens = math.min(capacity, stored + (elapsed * capacity / rate_ms))
+
+-- wait_for returns the time, in ms, until n tokens are available:
+-- the time left before refill_start, plus however long it takes the
+-- remaining tokens to accrue once it does.
+local function wait_for(n)
+	local need = n - tokens
+	if need <= 0 then
+		return 0
+	end
+	return (refill_start - now_ms) + math.ceil(need * rate_ms / capacity)
+end
+
+-- Preserve a future-pinned last across calls instead of collapsing it
+-- back to now_ms, so a Penalize doesn't get silently cut short by the
+-- very next Consume it was meant to reject; extend the keys' TTL to
+-- match so they don't expire out from under it either.
+local new_ts = now_ms
+if last > now_ms then
+	new_ts = last
+end
+local ttl_ms = math.max(rate_ms, (new_ts - now_ms) + rate_ms)
+
+if tokens < amount then
+	local reset_ms = wait_for(amount)
+	redis.call("SET", tokens_key, tokens)
+	redis.call("PEXPIRE", tokens_key, ttl_ms)
+	redis.call("SET", ts_key, new_ts)
+	redis.call("PEXPIRE", ts_key, ttl_ms)
+	return {0, math.floor(tokens), reset_ms}
+end
+
+tokens = tokens - amount
+local reset_ms = wait_for(capacity)
+
+redis.call("SET", tokens_key, tokens)
+redis.call("PEXPIRE", tokens_key, ttl_ms)
+redis.call("SET", ts_key, new_ts)
+redis.call("PEXPIRE", ts_key, ttl_ms)
+
+return {1, math.floor(tokens), reset_ms}
+`
+
 // Bucket implements the limit.Bucket interface backed by a
 // redis persistance layer.
 type Bucket struct {
-	// redis transactions are sequential, so perhaps the
-	// mutex protecting values here is not required.
-	sync.Mutex
-
-	rdb *redis.Client
+	rdb redis.UniversalClient
 
 	// key should be shared between replicas of the program
 	// using this rate limiter.
 	key      string
 	capacity int
-	space    int
-	reset    time.Time
 	rate     time.Duration
+
+	// scriptSHA is the SHA1 of tokenBucketScript, cached after
+	// SCRIPT LOAD so Consume can use the cheaper EVALSHA call.
+	scriptSHA string
 }
 
 // Consume implements the limit.Bucket interface.
-func (b *Bucket) Consume(amt int) (limit.State, error) {
-	// Leverage redis optimistic transactions to protect
-	// from concurrent writes.
-	err := b.rdb.Watch(func(tx *redis.Tx) error {
-		n, err := tx.Get(b.key).Int()
-		if err != nil {
-			if err == redis.Nil {
-				// set key:
-				b.rdb.Set(b.key, 0, b.rate)
-			} else {
-				return err
-			}
-		}
-		if n >= b.capacity {
-			b.drain() // attempt drain on exit.
-			return limit.ErrToManyRequests
-		}
+//
+// It evaluates tokenBucketScript on the redis server so the
+// check-and-decrement happens atomically, even when many replicas of
+// this program are consuming from the same key concurrently. ctx is
+// threaded into the command itself (see eval), so a cancellation or
+// deadline aborts an in-flight call, not just a queued one. key
+// namespaces the request under this Bucket's AppKey, so one Bucket
+// can rate limit several hosts or tenants independently; an empty key
+// consumes from the AppKey itself.
+func (b *Bucket) Consume(ctx context.Context, key string, amt int) (limit.State, error) {
+	if err := ctx.Err(); err != nil {
+		return limit.State{}, err
+	}
 
-		var count int64
-		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
-			count, err = tx.IncrBy(b.key, int64(amt)).Result()
-			return err
-		})
+	now := time.Now()
 
-		// check for bucket overflow.
-		if int(count) > b.capacity {
-			b.drain() // attempt drain on exit.
-			return limit.ErrToManyRequests
-		}
+	res, err := b.eval(ctx, b.namespace(key), now, amt)
+	if err != nil {
+		return limit.State{}, err
+	}
 
-		b.Lock()
-		b.space = b.capacity - int(count)
-		b.Unlock()
+	allowed, ok1 := res[0].(int64)
+	remaining, ok2 := res[1].(int64)
+	resetMs, ok3 := res[2].(int64)
+	if !ok1 || !ok2 || !ok3 {
+		return limit.State{}, errors.New("redis: unexpected token bucket script response")
+	}
 
-		b.drain()
+	state := limit.State{
+		Capacity: b.capacity,
+		Space:    int(remaining),
+		Reset:    now.Add(time.Duration(resetMs) * time.Millisecond),
+	}
 
-		return nil
-	}, b.key)
+	if allowed == 0 {
+		return state, limit.ErrToManyRequests
+	}
 
-	return b.state(), err
+	return state, nil
 }
 
-func (b *Bucket) drain() error {
-	return b.rdb.Watch(func(tx *redis.Tx) error {
+// Reserve implements limit.Reserver by delegating to limit.Reserve,
+// which attempts Consume immediately and, if key is over limit, sleeps
+// until state.Reset before retrying once, or returns
+// limit.ErrToManyRequests without sleeping if that's beyond maxWait.
+func (b *Bucket) Reserve(ctx context.Context, key string, amt int, maxWait time.Duration) (limit.State, error) {
+	return limit.Reserve(ctx, b, key, amt, maxWait)
+}
 
-		pttl, err := b.rdb.Do("PTTL", b.key).Int()
-		if err != nil && err != redis.Nil {
-			return err
-		}
+// Penalize implements limit.Penalizer. It zeroes key's remaining
+// tokens and pins its refill timestamp to until, which the token
+// bucket script treats as "not due to refill yet", so no replica
+// sharing this Bucket can consume from key again before then.
+//
+// The two SETs have no read-dependent precondition, so unlike Consume
+// they don't need a script. They do still need TxPipelined rather
+// than a plain Pipelined, though: without the MULTI/EXEC wrapper a
+// concurrent EVALSHA could interleave between them and observe a
+// zeroed tokens_key alongside a ts_key that hasn't been pushed out
+// yet, refilling early.
+func (b *Bucket) Penalize(ctx context.Context, key string, until time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-		if pttl < 1 || err == redis.Nil {
-			// todo, check if I need to reset here.
-			_, err := b.rdb.Set(b.key, 0, b.rate).Result()
-			if err != nil {
-				return err
-			}
-		}
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		return nil
+	}
+
+	namespacedKey := b.namespace(key)
+	tokensKey := namespacedKey
+	tsKey := namespacedKey + ":ts"
+	untilMs := until.UnixNano() / int64(time.Millisecond)
 
-		b.Lock()
-		defer b.Unlock()
-		b.reset = time.Now().Add(time.Duration(pttl) * time.Millisecond)
+	_, err := b.rdb.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(tokensKey, 0, ttl)
+		pipe.Set(tsKey, untilMs, ttl)
 		return nil
-	}, b.key)
+	})
+
+	return err
 }
 
-func (b *Bucket) state() limit.State {
-	return limit.State{
-		Capacity: b.capacity,
-		Space:    b.space,
-		Reset:    b.reset,
+// namespace qualifies key under this Bucket's AppKey so distinct
+// Buckets, or distinct keys within one Bucket, never collide in redis.
+func (b *Bucket) namespace(key string) string {
+	if key == "" {
+		return b.key
 	}
+	return b.key + ":" + key
 }
 
+// eval runs tokenBucketScript via EVALSHA, loading it with EVAL on a
+// NOSCRIPT miss (e.g. after a redis restart or FLUSHALL).
+//
+// redis.UniversalClient has no WithContext method (unlike the
+// concrete *redis.Client), so it can't be used to bind ctx the way
+// the Cmdable helpers (EvalSha, Eval, ...) expect. ProcessContext is
+// part of the UniversalClient interface, though, and every
+// implementation wires it into the underlying connection's
+// read/write deadlines, so building the same command EvalSha/Eval
+// would and running it through ProcessContext gets ctx genuinely
+// threaded into the call instead of only checked beforehand.
+func (b *Bucket) eval(ctx context.Context, namespacedKey string, now time.Time, amt int) ([]interface{}, error) {
+	keys := []string{namespacedKey, namespacedKey + ":ts"}
+	args := []interface{}{
+		b.capacity,
+		b.rate.Milliseconds(),
+		now.UnixNano() / int64(time.Millisecond),
+		amt,
+	}
+
+	arr, err := b.evalCmd(ctx, "evalsha", b.scriptSHA, keys, args)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		arr, err = b.evalCmd(ctx, "eval", tokenBucketScript, keys, args)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return arr, nil
+}
+
+// evalCmd builds the same command EVALSHA/EVAL (name is "evalsha" or
+// "eval") would and runs it via ProcessContext so ctx reaches the
+// call itself.
+func (b *Bucket) evalCmd(ctx context.Context, name, sha1OrScript string, keys []string, args []interface{}) ([]interface{}, error) {
+	cmdArgs := make([]interface{}, 3+len(keys), 3+len(keys)+len(args))
+	cmdArgs[0] = name
+	cmdArgs[1] = sha1OrScript
+	cmdArgs[2] = len(keys)
+	for i, key := range keys {
+		cmdArgs[3+i] = key
+	}
+	cmdArgs = append(cmdArgs, args...)
+
+	cmd := redis.NewCmd(cmdArgs...)
+	if err := b.rdb.ProcessContext(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	res, err := cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+
+	arr, ok := res.([]interface{})
+	if !ok || len(arr) != 3 {
+		return nil, errors.New("redis: unexpected token bucket script response")
+	}
+
+	return arr, nil
+}
+
+// NewBucket constructs a redis client from cfg (standalone, sentinel,
+// or cluster, depending on which fields are set) and returns a Bucket
+// backed by it.
 func NewBucket(cfg Config) (*Bucket, error) {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     cfg.RedisAddr,
-		Password: cfg.RedisPwd,
-		DB:       cfg.RedisDB,
-	})
-	_, err := rdb.Ping().Result()
+	rdb, err := newUniversalClient(cfg)
 	if err != nil {
 		return &Bucket{}, err
 	}
 
+	return NewBucketWithClient(rdb, cfg)
+}
+
+// NewBucketWithClient returns a Bucket backed by rdb, a caller-supplied
+// redis client. This lets callers who already maintain a redis
+// connection (standalone, sentinel-backed, or clustered) share it with
+// the rate limiter instead of opening a second one. cfg's Redis*,
+// RedisURL, Sentinel and Cluster fields are ignored.
+func NewBucketWithClient(rdb redis.UniversalClient, cfg Config) (*Bucket, error) {
 	if cfg.AppKey == "" {
 		return &Bucket{}, errors.New("please provide appkey")
 	}
 
+	if _, err := rdb.Ping().Result(); err != nil {
+		return &Bucket{}, err
+	}
+
+	sha, err := rdb.ScriptLoad(tokenBucketScript).Result()
+	if err != nil {
+		return &Bucket{}, err
+	}
+
 	return &Bucket{
-		rdb:      rdb,
-		capacity: cfg.RequestLimit,
-		rate:     cfg.LimitDuration,
-		key:      cfg.AppKey,
+		rdb:       rdb,
+		capacity:  cfg.RequestLimit,
+		rate:      cfg.LimitDuration,
+		key:       cfg.AppKey,
+		scriptSHA: sha,
 	}, nil
+}
 
+// newUniversalClient builds the redis.UniversalClient described by cfg.
+// Cluster takes precedence over Sentinel, which takes precedence over
+// RedisURL, which takes precedence over the RedisAddr/RedisPwd/RedisDB
+// standalone fields.
+func newUniversalClient(cfg Config) (redis.UniversalClient, error) {
+	switch {
+	case cfg.Cluster != nil:
+		return redis.NewClusterClient(cfg.Cluster), nil
+	case cfg.Sentinel != nil:
+		return redis.NewFailoverClient(cfg.Sentinel), nil
+	case cfg.RedisURL != "":
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClient(opts), nil
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:     cfg.RedisAddr,
+			Password: cfg.RedisPwd,
+			DB:       cfg.RedisDB,
+		}), nil
+	}
 }
 
 // Config represents the configuration for a redis backed leaky-bucket
@@ -132,10 +340,24 @@ type Config struct {
 	// It should be the same value for all instances.
 	AppKey string
 
+	// Standalone redis, used when RedisURL, Sentinel and Cluster are
+	// all unset.
 	RedisAddr string
 	RedisPwd  string
 	RedisDB   int // default 0
 
+	// RedisURL, parsed with redis.ParseURL, is an alternative to
+	// RedisAddr/RedisPwd/RedisDB for standalone redis.
+	RedisURL string
+
+	// Sentinel, when set, connects via a sentinel-monitored failover
+	// group instead of a single address.
+	Sentinel *redis.FailoverOptions
+
+	// Cluster, when set, connects to a redis cluster instead of a
+	// single node.
+	Cluster *redis.ClusterOptions
+
 	RequestLimit  int
 	LimitDuration time.Duration
 }
@@ -1,12 +1,15 @@
 package redis
 
 import (
-	"net/http"
-	"net/http/httptest"
+	"context"
+	"io"
+	"net"
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis/v7"
 	"github.com/tjcain/limit"
+	"github.com/tjcain/limit/limittest"
 )
 
 const (
@@ -17,52 +20,225 @@ const (
 var defaultTestCfg = Config{
 	RedisAddr:     localRedis,
 	AppKey:        defaultAppKey,
-	RequestLimit:  2,
-	LimitDuration: time.Second,
+	RequestLimit:  limittest.Capacity,
+	LimitDuration: limittest.Rate,
 }
 
 func Test_Bucket_Sync(t *testing.T) {
-	client, url, teardown := setup(defaultTestCfg)
+	bucket, teardown := newTestBucket(t)
 	defer teardown()
 
-	req, _ := http.NewRequest("GET", url, nil)
+	limittest.Sync(t, bucket)
+}
+
+func Test_Bucket_Concurrency(t *testing.T) {
+	bucket, teardown := newTestBucket(t)
+	defer teardown()
+
+	limittest.Concurrency(t, bucket)
+}
+
+func Test_Bucket_Reserve(t *testing.T) {
+	bucket, teardown := newTestBucket(t)
+	defer teardown()
 
-	for i := 0; i < defaultTestCfg.RequestLimit*2; i++ {
-		resp, err := client.Do(req)
-		if err != nil {
-			t.Fatal(err)
+	limittest.Reserve(t, bucket)
+}
+
+func Test_Bucket_Penalize(t *testing.T) {
+	bucket, teardown := newTestBucket(t)
+	defer teardown()
+
+	limittest.Penalize(t, bucket)
+}
+
+// Test_Bucket_Consume_ResetAccountsForAmount guards against reset_ms
+// being computed from capacity instead of the requested amount: on an
+// exhausted Capacity=2 bucket, asking for 1 token back should report
+// a wait of about half the full rate, not a whole rate period.
+func Test_Bucket_Consume_ResetAccountsForAmount(t *testing.T) {
+	bucket, teardown := newTestBucket(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	if _, err := bucket.Consume(ctx, "", limittest.Capacity); err != nil {
+		t.Fatalf("expected Consume to drain the bucket, got %v", err)
+	}
+
+	start := time.Now()
+	state, err := bucket.Consume(ctx, "", 1)
+	if err != limit.ErrToManyRequests {
+		t.Fatalf("expected ErrToManyRequests, got %v", err)
+	}
+
+	wait := state.Reset.Sub(start)
+	maxExpected := limittest.Rate/time.Duration(limittest.Capacity) + 250*time.Millisecond
+	if wait > maxExpected {
+		t.Errorf("expected Reset to need about 1/%d of Rate (~%s) for 1 token, got %s",
+			limittest.Capacity, limittest.Rate/time.Duration(limittest.Capacity), wait)
+	}
+}
+
+func Test_Bucket_Consume_CancelledContext(t *testing.T) {
+	bucket, teardown := newTestBucket(t)
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		_, err := bucket.Consume(ctx, "", 1)
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
 		}
+		close(done)
+	}()
 
-		if i >= defaultTestCfg.RequestLimit {
-			if resp.StatusCode != 429 {
-				t.Errorf("expected status 429, got %d", resp.StatusCode)
-			}
-		} else {
-			if resp.StatusCode != 200 {
-				t.Errorf("expected status 200, got %d", resp.StatusCode)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Consume did not return promptly after context cancellation")
+	}
+}
+
+// Test_Bucket_Consume_ContextDeadline_DuringCall guards against the
+// regression where dropping redis.Client.WithContext (UniversalClient
+// has no such method) left ctx checked only before the EVALSHA round
+// trip, not threaded into it. Unlike Test_Bucket_Consume_CancelledContext,
+// ctx here is still live when Consume is called, so this only passes
+// if ctx's deadline actually aborts the in-flight call; the command is
+// sent to a listener that never replies, so without real propagation
+// Consume would instead block for the client's full read timeout.
+func Test_Bucket_Consume_ContextDeadline_DuringCall(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
 			}
+			go io.Copy(io.Discard, conn)
 		}
+	}()
+
+	bucket := &Bucket{
+		rdb:      redis.NewClient(&redis.Options{Addr: ln.Addr().String()}),
+		key:      defaultAppKey,
+		capacity: limittest.Capacity,
+		rate:     limittest.Rate,
+	}
+	defer bucket.rdb.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = bucket.Consume(ctx, "", 1)
+	elapsed := time.Since(start)
+
+	// go-redis surfaces this as the underlying net.Conn's read timeout
+	// rather than rewrapping it as ctx.Err(), but what matters here is
+	// that the deadline - set on the connection from ctx, per
+	// (*pool.Conn).deadline - is what ends the call, not the client's
+	// own (much longer) default ReadTimeout.
+	nerr, ok := err.(net.Error)
+	if !ok || !nerr.Timeout() {
+		t.Errorf("expected a net.Error timeout once ctx's deadline passed, got %v", err)
+	}
+	if elapsed > time.Second {
+		t.Errorf("expected Consume to abort once ctx's deadline (50ms) passed, took %s", elapsed)
 	}
 }
 
-// TODO: add tests for concurrency (currently leveraging go-redis implementation of
-// concurrent txns).
+// Test_newUniversalClient_Precedence covers Cluster > Sentinel >
+// RedisURL > RedisAddr without dialing a server: all four constructors
+// involved (NewClusterClient, NewFailoverClient, ParseURL+NewClient,
+// NewClient) are lazy, so the precedence logic can be verified from
+// the returned client's type and Options alone.
+func Test_newUniversalClient_Precedence(t *testing.T) {
+	cluster := &redis.ClusterOptions{Addrs: []string{"localhost:7000"}}
+	sentinel := &redis.FailoverOptions{MasterName: "mymaster", SentinelAddrs: []string{"localhost:26379"}}
 
-func setup(cfg Config) (*http.Client, string, func()) {
-	bucket, err := NewBucket(cfg)
-	if err != nil {
-		panic(err)
+	cases := []struct {
+		name        string
+		cfg         Config
+		wantCluster bool
+		wantAddr    string
+	}{
+		{
+			name:        "cluster takes precedence over sentinel, RedisURL and RedisAddr",
+			cfg:         Config{Cluster: cluster, Sentinel: sentinel, RedisURL: "redis://urlhost:6380", RedisAddr: "addrhost:6381"},
+			wantCluster: true,
+		},
+		{
+			name:     "sentinel takes precedence over RedisURL and RedisAddr",
+			cfg:      Config{Sentinel: sentinel, RedisURL: "redis://urlhost:6380", RedisAddr: "addrhost:6381"},
+			wantAddr: "FailoverClient",
+		},
+		{
+			name:     "RedisURL takes precedence over RedisAddr",
+			cfg:      Config{RedisURL: "redis://urlhost:6380", RedisAddr: "addrhost:6381"},
+			wantAddr: "urlhost:6380",
+		},
+		{
+			name:     "RedisAddr is the fallback",
+			cfg:      Config{RedisAddr: "addrhost:6381"},
+			wantAddr: "addrhost:6381",
+		},
 	}
 
-	server := httptest.NewServer(
-		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Write([]byte("OK"))
-		}))
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rdb, err := newUniversalClient(c.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rdb.Close()
 
-	transport := limit.NewTransport(bucket)
-	client := http.Client{Transport: transport}
+			if c.wantCluster {
+				if _, ok := rdb.(*redis.ClusterClient); !ok {
+					t.Errorf("expected a *redis.ClusterClient, got %T", rdb)
+				}
+				return
+			}
+
+			client, ok := rdb.(*redis.Client)
+			if !ok {
+				t.Fatalf("expected a *redis.Client, got %T", rdb)
+			}
+			if addr := client.Options().Addr; addr != c.wantAddr {
+				t.Errorf("expected Addr %q, got %q", c.wantAddr, addr)
+			}
+		})
+	}
+}
+
+// Test_NewBucketWithClient_RequiresAppKey checks that AppKey is
+// validated before NewBucketWithClient ever dials rdb, so this doesn't
+// need a live server either.
+func Test_NewBucketWithClient_RequiresAppKey(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: localRedis})
+	defer rdb.Close()
+
+	if _, err := NewBucketWithClient(rdb, Config{}); err == nil {
+		t.Error("expected an error when AppKey is empty")
+	}
+}
+
+func newTestBucket(t *testing.T) (*Bucket, func()) {
+	bucket, err := NewBucket(defaultTestCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	return &client, server.URL, func() {
+	return bucket, func() {
 		bucket.rdb.FlushAll()
 	}
 }